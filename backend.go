@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	certmanagerv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha1"
+	"github.com/softlayer/softlayer-go/services"
+	"github.com/softlayer/softlayer-go/session"
+)
+
+// ZoneRef identifies a DNS zone in a backend's own addressing scheme, e.g. a
+// SoftLayer numeric domain id or a CIS zone id. Domain is the zone's domain
+// name (e.g. "example.com", no trailing dot), as passed into FindZone, so
+// that PresentTXT/CleanupTXT can derive the record name each backend's API
+// actually expects.
+type ZoneRef struct {
+	ID     string
+	Domain string
+}
+
+// dnsBackend is the provider-specific surface softlayerDNSProviderSolver
+// drives once it has decided which backend owns a given zone. Each DNS
+// provider (SoftLayer classic DNS, IBM CIS, ...) implements this once,
+// mirroring how lego structures its provider packages, instead of each
+// provider duplicating the cert-manager Solver skeleton.
+//
+// PresentTXT and CleanupTXT are given the full ACME-resolved FQDN rather
+// than a pre-trimmed record name, since backends disagree on what they
+// need: SoftLayer's API wants a host name relative to the zone, CIS's
+// wants the fully-qualified record name. Each implementation derives its
+// own record name from fqdn and zone.
+type dnsBackend interface {
+	// FindZone resolves the zone that should hold records for the
+	// (already-resolved) zone domain cert-manager gave us, e.g.
+	// "example.com.".
+	FindZone(fqdn string) (ZoneRef, error)
+	// PresentTXT ensures a TXT record with value exists for fqdn within
+	// zone. It must tolerate being called when the record already exists.
+	PresentTXT(zone ZoneRef, fqdn, value string, ttl int) error
+	// CleanupTXT removes the TXT record with value for fqdn within zone, if
+	// present, leaving any other records at that name untouched.
+	CleanupTXT(zone ZoneRef, fqdn, value string) error
+}
+
+// zoneOverrideConfig routes a single zone suffix to a backend other than the
+// webhook's top-level SoftLayer configuration.
+type zoneOverrideConfig struct {
+	// Backend selects the dnsBackend implementation for this zone: currently
+	// "softlayer" (the default when omitted) or "ibmcloud-cis".
+	Backend string `json:"backend"`
+
+	// Username and APIKeySecretRef are used when Backend is "softlayer", and
+	// behave the same as the top-level fields of the same name.
+	Username        string                          `json:"username,omitempty"`
+	APIKeySecretRef certmanagerv1.SecretKeySelector `json:"apiKeySecretRef,omitempty"`
+
+	// CRN and ZoneID are used when Backend is "ibmcloud-cis", and behave the
+	// same as the matching fields of cisDNSProviderConfig. APIKeySecretRef
+	// above is reused for the CIS IAM API key.
+	CRN    string `json:"crn,omitempty"`
+	ZoneID string `json:"zoneID,omitempty"`
+}
+
+// backendFor resolves the dnsBackend that should handle zone, consulting
+// cfg.ZoneOverrides before falling back to the top-level SoftLayer config.
+func (c *softlayerDNSProviderSolver) backendFor(cfg *softlayerDNSProviderConfig, namespace, zone string) (dnsBackend, error) {
+	if override, ok := matchZoneOverride(cfg.ZoneOverrides, zone); ok {
+		return c.backendFromOverride(&override, namespace)
+	}
+
+	sess, err := c.provider(cfg, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get provider: %s", err)
+	}
+
+	return &softlayerBackend{session: sess, username: cfg.Username, zoneCache: c.zoneCache}, nil
+}
+
+// matchZoneOverride returns the override registered for the longest suffix
+// of zone found in overrides, if any.
+func matchZoneOverride(overrides map[string]zoneOverrideConfig, zone string) (zoneOverrideConfig, bool) {
+	zone = strings.TrimSuffix(zone, ".")
+
+	var best string
+	var bestOverride zoneOverrideConfig
+	found := false
+
+	for suffix, override := range overrides {
+		trimmed := strings.TrimSuffix(suffix, ".")
+		if zone != trimmed && !strings.HasSuffix(zone, "."+trimmed) {
+			continue
+		}
+		if !found || len(trimmed) > len(best) {
+			best = trimmed
+			bestOverride = override
+			found = true
+		}
+	}
+
+	return bestOverride, found
+}
+
+// backendFromOverride builds the dnsBackend named by override.Backend.
+func (c *softlayerDNSProviderSolver) backendFromOverride(override *zoneOverrideConfig, namespace string) (dnsBackend, error) {
+	switch override.Backend {
+	case "", "softlayer":
+		sess, err := c.provider(&softlayerDNSProviderConfig{
+			Username:        override.Username,
+			APIKeySecretRef: override.APIKeySecretRef,
+		}, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get provider for zone override: %s", err)
+		}
+		return &softlayerBackend{session: sess, username: override.Username, zoneCache: c.zoneCache}, nil
+
+	case "ibmcloud-cis":
+		apiKey, err := secretValue(c.client, c.secrets, namespace, override.APIKeySecretRef)
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := exchangeIAMToken(apiKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to exchange IAM api key: %s", err)
+		}
+
+		return &cisBackend{client: &cisClient{
+			httpClient: &http.Client{Timeout: cisHTTPTimeout},
+			crn:        override.CRN,
+			zoneID:     override.ZoneID,
+			bearer:     token,
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown backend %q in zoneOverrides", override.Backend)
+	}
+}
+
+// softlayerBackend implements dnsBackend against classic SoftLayer DNS.
+type softlayerBackend struct {
+	session *session.Session
+	// username and zoneCache are used to serve FindZone out of the
+	// webhook's zone id cache, keyed by (username, zone). zoneCache is nil
+	// when caching is disabled.
+	username  string
+	zoneCache *zoneCache
+}
+
+func (b *softlayerBackend) FindZone(fqdn string) (ZoneRef, error) {
+	if b.zoneCache != nil {
+		if entry, ok := b.zoneCache.get(b.username, fqdn); ok {
+			if entry.err != nil {
+				return ZoneRef{}, entry.err
+			}
+			return ZoneRef{ID: strconv.Itoa(*entry.id), Domain: strings.TrimSuffix(fqdn, ".")}, nil
+		}
+	}
+
+	id, err := getHostedZone(b.session, fqdn)
+
+	if b.zoneCache != nil {
+		b.zoneCache.set(b.username, fqdn, id, err)
+	}
+
+	if err != nil {
+		return ZoneRef{}, err
+	}
+	return ZoneRef{ID: strconv.Itoa(*id), Domain: strings.TrimSuffix(fqdn, ".")}, nil
+}
+
+func (b *softlayerBackend) PresentTXT(zone ZoneRef, fqdn, value string, ttl int) error {
+	zoneID, err := strconv.Atoi(zone.ID)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(fqdn, "."), "."+zone.Domain)
+
+	records, err := findTxtRecords(b.session, zoneID, name)
+	if err != nil {
+		return fmt.Errorf("unable to find txt records: %s", err)
+	}
+
+	existing := make([]txtRecord, 0, len(records))
+	for _, r := range records {
+		existing = append(existing, txtRecord{Name: *r.Host, Value: *r.Data})
+	}
+
+	if txtRecordWithValue(existing, value) != nil {
+		// already present, Present must tolerate repeat calls.
+		return nil
+	}
+
+	svc := services.GetDnsDomainService(b.session)
+	_, err = svc.Id(zoneID).CreateTxtRecord(&name, &value, &ttl)
+	return err
+}
+
+func (b *softlayerBackend) CleanupTXT(zone ZoneRef, fqdn, value string) error {
+	zoneID, err := strconv.Atoi(zone.ID)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(fqdn, "."), "."+zone.Domain)
+
+	records, err := findTxtRecords(b.session, zoneID, name)
+	if err != nil {
+		return err
+	}
+
+	record := findTxtRecordByKey(records, value)
+	if record == nil {
+		return nil
+	}
+
+	svc := services.GetDnsDomainResourceRecordService(b.session)
+	del, err := svc.Id(*record.Id).DeleteObject()
+	if del == false || err != nil {
+		return err
+	}
+	return nil
+}
+
+// cisBackend implements dnsBackend against IBM Cloud Internet Services.
+// Unlike softlayerBackend, the zone is already known from configuration, so
+// FindZone does not need to perform a lookup.
+type cisBackend struct {
+	client *cisClient
+}
+
+func (b *cisBackend) FindZone(fqdn string) (ZoneRef, error) {
+	return ZoneRef{ID: b.client.zoneID, Domain: strings.TrimSuffix(fqdn, ".")}, nil
+}
+
+// PresentTXT uses the fully-qualified record name, as the CIS v1 DNS Records
+// API (unlike SoftLayer's) expects it rather than a zone-relative host name.
+func (b *cisBackend) PresentTXT(zone ZoneRef, fqdn, value string, ttl int) error {
+	name := strings.TrimSuffix(fqdn, ".")
+
+	records, err := b.client.listTXTRecords(name)
+	if err != nil {
+		return fmt.Errorf("unable to list txt records: %s", err)
+	}
+
+	if txtRecordWithValue(records, value) != nil {
+		return nil
+	}
+
+	return b.client.createTXTRecord(name, value, ttl)
+}
+
+func (b *cisBackend) CleanupTXT(zone ZoneRef, fqdn, value string) error {
+	name := strings.TrimSuffix(fqdn, ".")
+
+	records, err := b.client.listTXTRecordsRaw(name)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if r.Content == value {
+			return b.client.deleteDNSRecord(r.ID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// zoneCacheEntry holds a cached SoftLayer zone lookup result. id is nil and
+// err is non-nil for a cached negative result (e.g. "no such domain").
+type zoneCacheEntry struct {
+	id        *int
+	err       error
+	expiresAt time.Time
+}
+
+// zoneCache caches resolved SoftLayer zone ids keyed by (username, zone), so
+// that bulk certificate renewals don't each re-run an Account.getDomains
+// filter call against SoftLayer. Negative results are cached for a shorter
+// window than positive ones, so a genuinely missing zone isn't hammered on
+// every Present/CleanUp call, while a zone that's just been created is
+// picked up again soon.
+type zoneCache struct {
+	mu          sync.Mutex
+	entries     map[string]zoneCacheEntry
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+func newZoneCache(ttl, negativeTTL time.Duration) *zoneCache {
+	return &zoneCache{
+		entries:     make(map[string]zoneCacheEntry),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+func zoneCacheKey(username, zone string) string {
+	return username + "|" + zone
+}
+
+// get returns the cached entry for (username, zone), if one exists and
+// hasn't expired.
+func (c *zoneCache) get(username, zone string) (zoneCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[zoneCacheKey(username, zone)]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return zoneCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// set records the result of resolving (username, zone), using the shorter
+// negativeTTL when err is non-nil.
+func (c *zoneCache) set(username, zone string, id *int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+
+	c.entries[zoneCacheKey(username, zone)] = zoneCacheEntry{
+		id:        id,
+		err:       err,
+		expiresAt: time.Now().Add(ttl),
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	certmanagerv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+const (
+	cisAPIBaseURL  = "https://api.cis.cloud.ibm.com"
+	iamTokenURL    = "https://iam.cloud.ibm.com/identity/token"
+	cisHTTPTimeout = 30 * time.Second
+	cisTXTTTL      = 120
+)
+
+// cisDNSProviderConfig is a structure that is used to decode into when
+// solving a DNS01 challenge against IBM Cloud Internet Services (CIS).
+// This information is provided by cert-manager via
+// issuer.spec.acme.dns01.providers.webhook.config.
+type cisDNSProviderConfig struct {
+	// CRN is the CIS service instance's Cloud Resource Name.
+	CRN string `json:"crn"`
+	// ZoneID is the id of the DNS zone within the CIS instance.
+	ZoneID string `json:"zoneID"`
+	// APIKeySecretRef references a Secret holding an IBM Cloud IAM API key
+	// with permission to manage DNS records on the above zone.
+	APIKeySecretRef certmanagerv1.SecretKeySelector `json:"apiKeySecretRef"`
+}
+
+// cisDNSProviderSolver implements the provider-specific logic needed to
+// 'present' an ACME challenge TXT record against IBM Cloud Internet
+// Services, the Cloudflare-based DNS product IBM Cloud customers are
+// migrating to as classic SoftLayer DNS is deprecated. It implements the
+// same `github.com/jetstack/cert-manager/pkg/acme/webhook.Solver` interface
+// as softlayerDNSProviderSolver so both can be registered with a single
+// webhook deployment.
+type cisDNSProviderSolver struct {
+	client *kubernetes.Clientset
+
+	// secrets lazily builds a per-namespace Secret informer, the same way
+	// softlayerDNSProviderSolver does, so repeated challenges against the
+	// same Issuer don't each hit the Kubernetes API for the IAM API key
+	// Secret. It is nil when caching is disabled.
+	secrets *namespacedSecretLister
+}
+
+// Name is used as the name for this DNS solver when referencing it on the
+// ACME Issuer resource.
+func (c *cisDNSProviderSolver) Name() string {
+	return "ibmcloud-cis-solver"
+}
+
+// Initialize will be called when the webhook first starts.
+func (c *cisDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
+	klog.Info("Initialize IBM Cloud CIS solver")
+	cl, err := kubernetes.NewForConfig(kubeClientConfig)
+	if err != nil {
+		return fmt.Errorf("unable to get k8s client: %s", err)
+	}
+
+	c.client = cl
+
+	if !*disableCache {
+		c.secrets = newNamespacedSecretLister(cl, stopCh, secretInformerResync)
+	}
+
+	return nil
+}
+
+// Present is responsible for actually presenting the DNS record with CIS.
+// This method should tolerate being called multiple times with the same
+// value. cert-manager itself will later perform a self check to ensure that
+// the solver has correctly configured the DNS provider.
+//
+// The actual TXT record diffing is delegated to cisBackend, the same
+// dnsBackend implementation the softlayer solver's zoneOverrides path uses,
+// so a zone can be migrated from one solver to the other without a change
+// in behaviour.
+func (c *cisDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
+	klog.Infof("call present: namespace=%s, zone=%s", ch.ResourceNamespace, ch.ResolvedZone)
+	backend, err := c.backendFor(ch)
+	if err != nil {
+		return err
+	}
+
+	if err := backend.PresentTXT(ZoneRef{}, ch.ResolvedFQDN, ch.Key, cisTXTTTL); err != nil {
+		return fmt.Errorf("unable to present txt record: %s", err)
+	}
+
+	return nil
+}
+
+// CleanUp should delete the relevant TXT record from CIS. If multiple TXT
+// records exist with the same record name then only the record whose value
+// matches ch.Key is removed.
+func (c *cisDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
+	backend, err := c.backendFor(ch)
+	if err != nil {
+		return err
+	}
+
+	return backend.CleanupTXT(ZoneRef{}, ch.ResolvedFQDN, ch.Key)
+}
+
+// backendFor builds the cisBackend that should handle ch, using the CIS
+// client configured for ch's namespace and config.
+func (c *cisDNSProviderSolver) backendFor(ch *v1alpha1.ChallengeRequest) (*cisBackend, error) {
+	cfg, err := loadCISConfig(ch.Config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load config: %s", err)
+	}
+
+	client, err := c.clientFor(&cfg, ch.ResourceNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get CIS client: %s", err)
+	}
+
+	return &cisBackend{client: client}, nil
+}
+
+// loadCISConfig decodes JSON configuration into a cisDNSProviderConfig.
+func loadCISConfig(cfgJSON *extapi.JSON) (cisDNSProviderConfig, error) {
+	cfg := cisDNSProviderConfig{}
+	if cfgJSON == nil {
+		return cfg, nil
+	}
+	if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("error decoding solver config: %v", err)
+	}
+	return cfg, nil
+}
+
+// clientFor exchanges the IAM API key referenced by cfg for a bearer token
+// and returns a cisClient scoped to cfg's zone.
+func (c *cisDNSProviderSolver) clientFor(cfg *cisDNSProviderConfig, namespace string) (*cisClient, error) {
+	apiKey, err := secretValue(c.client, c.secrets, namespace, cfg.APIKeySecretRef)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := exchangeIAMToken(apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to exchange IAM api key: %s", err)
+	}
+
+	return &cisClient{
+		httpClient: &http.Client{Timeout: cisHTTPTimeout},
+		crn:        cfg.CRN,
+		zoneID:     cfg.ZoneID,
+		bearer:     token,
+	}, nil
+}
+
+// cisClient is a thin client for the CIS v1 DNS Records API, scoped to a
+// single zone.
+type cisClient struct {
+	httpClient *http.Client
+	crn        string
+	zoneID     string
+	bearer     string
+}
+
+// cisDNSRecord mirrors the subset of the CIS v1 DNS record representation
+// this webhook needs.
+type cisDNSRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+type cisDNSRecordListResponse struct {
+	Success bool           `json:"success"`
+	Result  []cisDNSRecord `json:"result"`
+	Errors  []cisAPIError  `json:"errors"`
+}
+
+type cisDNSRecordResponse struct {
+	Success bool          `json:"success"`
+	Result  cisDNSRecord  `json:"result"`
+	Errors  []cisAPIError `json:"errors"`
+}
+
+type cisAPIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *cisClient) recordsURL() string {
+	return fmt.Sprintf("%s/v1/%s/zones/%s/dns_records", cisAPIBaseURL, url.PathEscape(c.crn), c.zoneID)
+}
+
+// listTXTRecordsRaw returns every TXT record held at name, in CIS's own
+// representation.
+func (c *cisClient) listTXTRecordsRaw(name string) ([]cisDNSRecord, error) {
+	req, err := http.NewRequest(http.MethodGet, c.recordsURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("type", "TXT")
+	q.Set("name", name)
+	req.URL.RawQuery = q.Encode()
+	c.setHeaders(req)
+
+	var out cisDNSRecordListResponse
+	if err := c.do(req, &out); err != nil {
+		return nil, err
+	}
+
+	return out.Result, nil
+}
+
+// listTXTRecords returns every TXT record held at name as backend-agnostic
+// txtRecord values, so Present can diff them the same way softlayer does.
+func (c *cisClient) listTXTRecords(name string) ([]txtRecord, error) {
+	raw, err := c.listTXTRecordsRaw(name)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]txtRecord, 0, len(raw))
+	for _, r := range raw {
+		records = append(records, txtRecord{Name: r.Name, Value: r.Content})
+	}
+	return records, nil
+}
+
+// createTXTRecord creates a new TXT record at name with the given value and
+// ttl, in seconds.
+func (c *cisClient) createTXTRecord(name, value string, ttl int) error {
+	body, err := json.Marshal(cisDNSRecord{
+		Type:    "TXT",
+		Name:    name,
+		Content: value,
+		TTL:     ttl,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.recordsURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	var out cisDNSRecordResponse
+	return c.do(req, &out)
+}
+
+// deleteDNSRecord deletes the DNS record with the given CIS record id.
+func (c *cisClient) deleteDNSRecord(id string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.recordsURL()+"/"+id, nil)
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req)
+
+	return c.do(req, nil)
+}
+
+func (c *cisClient) setHeaders(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+c.bearer)
+	req.Header.Set("Accept", "application/json")
+}
+
+// do executes req and, if out is non-nil, decodes the JSON response body
+// into it. A non-2xx status or a CIS-reported failure is returned as an
+// error.
+func (c *cisClient) do(req *http.Request, out interface{}) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("CIS API call failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var status struct {
+		Success bool          `json:"success"`
+		Errors  []cisAPIError `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &status); err == nil && !status.Success {
+		return fmt.Errorf("CIS API reported failure: %+v", status.Errors)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unable to decode CIS API response: %s", err)
+	}
+
+	return nil
+}
+
+// iamTokenResponse is the subset of IBM Cloud IAM's token response this
+// webhook needs.
+type iamTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// exchangeIAMToken exchanges an IBM Cloud IAM API key for a short-lived
+// bearer token usable against the CIS API.
+func exchangeIAMToken(apiKey string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "urn:ibm:params:oauth:grant-type:apikey")
+	form.Set("apikey", apiKey)
+
+	req, err := http.NewRequest(http.MethodPost, iamTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := &http.Client{Timeout: cisHTTPTimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("IAM token exchange failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var tok iamTokenResponse
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", fmt.Errorf("unable to decode IAM token response: %s", err)
+	}
+
+	return tok.AccessToken, nil
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/miekg/dns"
 
 	certmanagerv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha1"
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
@@ -19,24 +24,49 @@ import (
 	"github.com/softlayer/softlayer-go/filter"
 	"github.com/softlayer/softlayer-go/services"
 	"github.com/softlayer/softlayer-go/session"
-
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var GroupName = os.Getenv("GROUP_NAME")
 
+// Defaults used when a softlayerDNSProviderConfig does not set its own
+// propagation check timing.
+const (
+	defaultPropagationTimeout = 120 * time.Second
+	defaultPollingInterval    = 5 * time.Second
+	dnsQueryTimeout           = 10 * time.Second
+)
+
+// secretInformerResync is how often each per-namespace Secret informer
+// (started on first use by namespacedSecretLister) performs a full relist,
+// independent of the TTLs below.
+const secretInformerResync = 10 * time.Minute
+
+var (
+	disableCache = flag.Bool("disable-cache", false,
+		"disable in-memory caching of credential Secrets and resolved SoftLayer DNS zone ids")
+	zoneCacheTTL = flag.Duration("zone-cache-ttl", 10*time.Minute,
+		"how long a resolved SoftLayer zone id is cached for")
+	zoneCacheNegativeTTL = flag.Duration("zone-cache-negative-ttl", 30*time.Second,
+		"how long a failed SoftLayer zone lookup is cached for")
+)
+
 func main() {
 	if GroupName == "" {
 		panic("GROUP_NAME must be specified")
 	}
 
-	// This will register our softlayer DNS provider with the webhook serving
-	// library, making it available as an API under the provided GroupName.
-	// You can register multiple DNS provider implementations with a single
-	// webhook, where the Name() method will be used to disambiguate between
-	// the different implementations.
+	flag.Parse()
+
+	// This will register our DNS provider solvers with the webhook serving
+	// library, making them available as an API under the provided GroupName.
+	// We register both the classic SoftLayer DNS solver and the IBM Cloud
+	// Internet Services (CIS) solver, where the Name() method will be used to
+	// disambiguate between the different implementations. This lets users
+	// migrate zones from SoftLayer DNS to CIS without redeploying the
+	// webhook.
 	cmd.RunWebhookServer(GroupName,
 		&softlayerDNSProviderSolver{},
+		&cisDNSProviderSolver{},
 	)
 }
 
@@ -46,6 +76,14 @@ func main() {
 // interface.
 type softlayerDNSProviderSolver struct {
 	client *kubernetes.Clientset
+
+	// secrets lazily builds a per-namespace Secret informer so Secret reads
+	// come from a cache instead of hitting the Kubernetes API on every
+	// Present/CleanUp call. It is nil when caching is disabled.
+	secrets *namespacedSecretLister
+	// zoneCache caches resolved SoftLayer zone ids, keyed by
+	// (username, resolved zone). It is nil when caching is disabled.
+	zoneCache *zoneCache
 }
 
 // softlayerDNSProviderConfig is a structure that is used to decode into when
@@ -70,6 +108,26 @@ type softlayerDNSProviderConfig struct {
 
 	Username        string                          `json:"username"`
 	APIKeySecretRef certmanagerv1.SecretKeySelector `json:"apiKeySecretRef"`
+
+	// PropagationTimeoutSeconds bounds how long Present will poll the zone's
+	// authoritative nameservers for the TXT record before giving up. Defaults
+	// to defaultPropagationTimeout when unset or zero.
+	PropagationTimeoutSeconds int `json:"propagationTimeoutSeconds"`
+	// PollingIntervalSeconds is the delay between successive propagation
+	// checks. Defaults to defaultPollingInterval when unset or zero.
+	PollingIntervalSeconds int `json:"pollingIntervalSeconds"`
+	// DisablePropagationCheck skips the authoritative-nameserver check
+	// entirely, relying solely on cert-manager's own self check.
+	DisablePropagationCheck bool `json:"disablePropagationCheck"`
+
+	// ZoneOverrides routes individual zones to a DNS backend other than the
+	// SoftLayer credentials configured above, keyed by zone suffix (e.g.
+	// "example.com."). This lets a single webhook deployment serve a mix of
+	// zones that are still on classic SoftLayer DNS and zones that have been
+	// migrated to another backend, without redeploying. The longest matching
+	// suffix wins; zones with no match fall back to the top-level SoftLayer
+	// config above.
+	ZoneOverrides map[string]zoneOverrideConfig `json:"zoneOverrides,omitempty"`
 }
 
 // Name is used as the name for this DNS solver when referencing it on the ACME
@@ -83,19 +141,12 @@ func (c *softlayerDNSProviderSolver) Name() string {
 }
 
 func (c *softlayerDNSProviderSolver) provider(cfg *softlayerDNSProviderConfig, namespace string) (*session.Session, error) {
-	sec, err := c.client.CoreV1().Secrets(namespace).Get(cfg.APIKeySecretRef.LocalObjectReference.Name, metav1.GetOptions{})
 	klog.Infof("config: %v", cfg)
+	apiKey, err := secretValue(c.client, c.secrets, namespace, cfg.APIKeySecretRef)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get secret: %v", err)
-	}
-
-	secBytes, ok := sec.Data[cfg.APIKeySecretRef.Key]
-	if !ok {
-		return nil, fmt.Errorf("Key %q not found in secret \"%s/%s\"", cfg.APIKeySecretRef.Key, cfg.APIKeySecretRef.LocalObjectReference.Name, namespace)
+		return nil, err
 	}
 
-	apiKey := string(secBytes)
-
 	return session.New(cfg.Username, apiKey), nil
 }
 
@@ -111,47 +162,26 @@ func (c *softlayerDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) erro
 		return fmt.Errorf("unable to load config: %s", err)
 	}
 
-	provider, err := c.provider(&cfg, ch.ResourceNamespace)
+	backend, err := c.backendFor(&cfg, ch.ResourceNamespace, ch.ResolvedZone)
 	if err != nil {
-		return fmt.Errorf("unable to get provider: %s", err)
+		return fmt.Errorf("unable to get dns backend: %s", err)
 	}
 
-	zone, err := c.getHostedZone(provider, ch.ResolvedZone)
+	zone, err := backend.FindZone(ch.ResolvedZone)
 	if err != nil {
 		return fmt.Errorf("unable to get hosted zone: %s", err)
 	}
 
-	// Look for existing records.
-	svc := services.GetDnsDomainService(provider)
-	records, err := svc.Id(*zone).GetResourceRecords()
-	if len(records) == 0 || err != nil {
-		return fmt.Errorf("unable to get resource records: %s", err)
-	}
-
-	entry := strings.TrimSuffix(ch.ResolvedFQDN, "."+ch.ResolvedZone)
-
-	recordsTxt, err := c.findTxtRecords(provider, *zone, entry, ch.Key)
-	if err != nil {
-		return fmt.Errorf("unable to find txt records: %s", err)
+	if err := backend.PresentTXT(zone, ch.ResolvedFQDN, ch.Key, 60); err != nil {
+		return fmt.Errorf("unable to present txt record: %s", err)
 	}
 
-	if len(recordsTxt) > 0 {
-		// the record is already set to the desired value
+	if cfg.DisablePropagationCheck {
 		return nil
 	}
 
-	if len(recordsTxt) >= 1 {
-		svcRecord := services.GetDnsDomainResourceRecordService(provider)
-		del, err := svcRecord.DeleteObjects(recordsTxt)
-		if del == false || err != nil {
-			return fmt.Errorf("unable to delete objects: %s", err)
-		}
-	}
-
-	ttl := 60
-	_, err = svc.Id(*zone).CreateTxtRecord(&entry, &ch.Key, &ttl)
-	if err != nil {
-		return fmt.Errorf("unable to create txt record: %s", err)
+	if err := waitForAuthoritativePropagation(&cfg, ch); err != nil {
+		return fmt.Errorf("unable to verify propagation: %s", err)
 	}
 
 	return nil
@@ -169,28 +199,17 @@ func (c *softlayerDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) erro
 		return err
 	}
 
-	provider, err := c.provider(&cfg, ch.ResourceNamespace)
+	backend, err := c.backendFor(&cfg, ch.ResourceNamespace, ch.ResolvedZone)
 	if err != nil {
 		return err
 	}
 
-	zone, err := c.getHostedZone(provider, ch.ResolvedZone)
+	zone, err := backend.FindZone(ch.ResolvedZone)
 	if err != nil {
 		return err
 	}
 
-	entry := strings.TrimSuffix(ch.ResolvedFQDN, "."+ch.ResolvedZone)
-	records, err := c.findTxtRecords(provider, *zone, entry, ch.Key)
-	if err != nil {
-		return err
-	}
-
-	svc := services.GetDnsDomainResourceRecordService(provider)
-	del, err := svc.DeleteObjects(records)
-	if del == false || err != nil {
-		return err
-	}
-	return nil
+	return backend.CleanupTXT(zone, ch.ResolvedFQDN, ch.Key)
 }
 
 // Initialize will be called when the webhook first starts.
@@ -210,6 +229,18 @@ func (c *softlayerDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, s
 	}
 
 	c.client = cl
+
+	if *disableCache {
+		return nil
+	}
+
+	// secrets builds one informer per namespace on demand (see
+	// namespacedSecretLister), rather than a single cluster-wide informer,
+	// so the webhook's ServiceAccount only needs Secret list/watch access in
+	// the namespaces it actually resolves challenges for.
+	c.secrets = newNamespacedSecretLister(cl, stopCh, secretInformerResync)
+	c.zoneCache = newZoneCache(*zoneCacheTTL, *zoneCacheNegativeTTL)
+
 	return nil
 }
 
@@ -229,7 +260,7 @@ func loadConfig(cfgJSON *extapi.JSON) (softlayerDNSProviderConfig, error) {
 }
 
 // getHostedZone returns the managed-zone
-func (c *softlayerDNSProviderSolver) getHostedZone(session *session.Session, domain string) (*int, error) {
+func getHostedZone(session *session.Session, domain string) (*int, error) {
 	svc := services.GetAccountService(session)
 
 	filters := filter.New(
@@ -253,7 +284,11 @@ func (c *softlayerDNSProviderSolver) getHostedZone(session *session.Session, dom
 	return zones[0].Id, nil
 }
 
-func (c *softlayerDNSProviderSolver) findTxtRecords(session *session.Session, zone int, entry, key string) ([]datatypes.Dns_Domain_ResourceRecord, error) {
+// findTxtRecords returns every TXT record held at entry within zone. Several
+// records can legitimately share the same host, e.g. when an apex and a
+// wildcard challenge for the same FQDN are being solved concurrently, so
+// callers must not assume there is at most one match.
+func findTxtRecords(session *session.Session, zone int, entry string) ([]datatypes.Dns_Domain_ResourceRecord, error) {
 	txtType := "txt"
 	// Look for existing records.
 	svc := services.GetDnsDomainService(session)
@@ -270,10 +305,112 @@ func (c *softlayerDNSProviderSolver) findTxtRecords(session *session.Session, zo
 
 	found := []datatypes.Dns_Domain_ResourceRecord{}
 	for _, r := range recs {
-		if *r.Type == txtType && *r.Host == entry && *r.Data == key {
+		if *r.Type == txtType && *r.Host == entry {
 			found = append(found, r)
 		}
 	}
 
 	return found, nil
 }
+
+// findTxtRecordByKey returns the record among records whose Data matches key
+// exactly, or nil if none does.
+func findTxtRecordByKey(records []datatypes.Dns_Domain_ResourceRecord, key string) *datatypes.Dns_Domain_ResourceRecord {
+	for i := range records {
+		if *records[i].Data == key {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// waitForAuthoritativePropagation polls the authoritative nameservers for
+// ch.ResolvedZone until one of them answers ch.ResolvedFQDN with a TXT record
+// matching ch.Key, or cfg's propagation timeout elapses. Running this check
+// before Present returns shortens the window before cert-manager's own self
+// check runs, which reduces spurious failures against slow-to-propagate
+// zones.
+func waitForAuthoritativePropagation(cfg *softlayerDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+	timeout := defaultPropagationTimeout
+	if cfg.PropagationTimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.PropagationTimeoutSeconds) * time.Second
+	}
+	interval := defaultPollingInterval
+	if cfg.PollingIntervalSeconds > 0 {
+		interval = time.Duration(cfg.PollingIntervalSeconds) * time.Second
+	}
+
+	nameservers, err := authoritativeNameservers(ch.ResolvedZone)
+	if err != nil {
+		return fmt.Errorf("unable to resolve authoritative nameservers for zone %s: %s", ch.ResolvedZone, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if txtRecordPropagated(nameservers, ch.ResolvedFQDN, ch.Key) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s to propagate to an authoritative nameserver for zone %s", timeout, ch.ResolvedFQDN, ch.ResolvedZone)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// authoritativeNameservers resolves the NS records for zone.
+func authoritativeNameservers(zone string) ([]string, error) {
+	nsRecords, err := net.LookupNS(strings.TrimSuffix(zone, "."))
+	if err != nil {
+		return nil, err
+	}
+	if len(nsRecords) == 0 {
+		return nil, fmt.Errorf("no nameservers found for zone %s", zone)
+	}
+
+	hosts := make([]string, 0, len(nsRecords))
+	for _, ns := range nsRecords {
+		hosts = append(hosts, ns.Host)
+	}
+	return hosts, nil
+}
+
+// txtRecordPropagated reports whether any of nameservers answers fqdn with a
+// TXT record whose value is key.
+func txtRecordPropagated(nameservers []string, fqdn, key string) bool {
+	for _, ns := range nameservers {
+		if queryTxtRecord(ns, fqdn, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryTxtRecord performs a direct, non-recursive TXT query against
+// nameserver for fqdn and reports whether key is among the returned values.
+func queryTxtRecord(nameserver, fqdn, key string) bool {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
+	m.RecursionDesired = false
+
+	client := &dns.Client{Timeout: dnsQueryTimeout}
+	resp, _, err := client.Exchange(m, net.JoinHostPort(nameserver, "53"))
+	if err != nil || resp == nil {
+		return false
+	}
+
+	for _, ans := range resp.Answer {
+		txt, ok := ans.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		for _, t := range txt.Txt {
+			if t == key {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	certmanagerv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	informercache "k8s.io/client-go/tools/cache"
+)
+
+// getSecretValue fetches ref.Key from the named Secret in namespace using
+// client. Both DNS backends accept credentials the same way (a
+// SecretKeySelector pointing at a namespaced Secret), so they share this
+// lookup rather than each re-implementing it.
+func getSecretValue(client *kubernetes.Clientset, namespace string, ref certmanagerv1.SecretKeySelector) (string, error) {
+	sec, err := client.CoreV1().Secrets(namespace).Get(ref.LocalObjectReference.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get secret: %v", err)
+	}
+
+	return extractSecretValue(sec, namespace, ref)
+}
+
+// extractSecretValue pulls ref.Key out of an already-fetched Secret. It is
+// split out from getSecretValue so that callers with their own route to a
+// Secret (e.g. an informer lister) can skip the API read but still share the
+// same key-lookup and error formatting.
+func extractSecretValue(sec *corev1.Secret, namespace string, ref certmanagerv1.SecretKeySelector) (string, error) {
+	secBytes, ok := sec.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("key %q not found in secret \"%s/%s\"", ref.Key, namespace, ref.LocalObjectReference.Name)
+	}
+
+	return string(secBytes), nil
+}
+
+// secretValue returns ref.Key from the named Secret in namespace, preferring
+// secrets (the namespace-scoped informer lister populated in Initialize) and
+// falling back to a direct API read via client when secrets is nil, i.e.
+// caching is disabled. Both DNS solvers share this rather than each keeping
+// their own copy.
+func secretValue(client *kubernetes.Clientset, secrets *namespacedSecretLister, namespace string, ref certmanagerv1.SecretKeySelector) (string, error) {
+	if secrets == nil {
+		return getSecretValue(client, namespace, ref)
+	}
+
+	return secrets.get(namespace, ref)
+}
+
+// namespacedSecretLister lazily builds a Secret informer scoped to each
+// namespace it is asked about, starting it the first time that namespace is
+// seen. This lets a webhook read credential Secrets from an informer cache
+// instead of hitting the API on every Present/CleanUp call without ever
+// needing cluster-wide `list`/`watch` access on Secrets -- only to the
+// namespaces it actually serves challenges for. Both DNS solvers use this
+// type; each builds its own instance in Initialize, so each keeps its own
+// set of informers.
+type namespacedSecretLister struct {
+	listers sync.Map // namespace (string) -> corelisters.SecretLister
+
+	// mus guards, per namespace, the first-time informer bring-up below so
+	// that two concurrent Present/CleanUp calls for a brand-new namespace
+	// don't each start their own informer. It is keyed separately from
+	// listers so a cold namespace's bring-up never blocks a lookup against
+	// an already-warm one.
+	mus   sync.Map // namespace (string) -> *sync.Mutex
+	musMu sync.Mutex
+
+	client *kubernetes.Clientset
+	stopCh <-chan struct{}
+	resync time.Duration
+}
+
+func newNamespacedSecretLister(client *kubernetes.Clientset, stopCh <-chan struct{}, resync time.Duration) *namespacedSecretLister {
+	return &namespacedSecretLister{
+		client: client,
+		stopCh: stopCh,
+		resync: resync,
+	}
+}
+
+// get fetches ref.Key from the named Secret in namespace, using (and lazily
+// starting) a Secret informer scoped to that namespace.
+func (l *namespacedSecretLister) get(namespace string, ref certmanagerv1.SecretKeySelector) (string, error) {
+	lister, err := l.listerFor(namespace)
+	if err != nil {
+		return "", err
+	}
+
+	sec, err := lister.Secrets(namespace).Get(ref.LocalObjectReference.Name)
+	if err != nil {
+		return "", fmt.Errorf("unable to get secret: %v", err)
+	}
+
+	return extractSecretValue(sec, namespace, ref)
+}
+
+// listerFor returns the Secret lister for namespace, starting its informer
+// on first use. Bring-up for one namespace is serialized only against other
+// bring-ups for that same namespace (via namespaceLock), so a cold namespace
+// still waiting on WaitForCacheSync never blocks a lookup against a
+// namespace whose lister is already cached.
+func (l *namespacedSecretLister) listerFor(namespace string) (corelisters.SecretLister, error) {
+	if lister, ok := l.listers.Load(namespace); ok {
+		return lister.(corelisters.SecretLister), nil
+	}
+
+	mu := l.namespaceLock(namespace)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Another goroutine may have finished bring-up while we waited on mu.
+	if lister, ok := l.listers.Load(namespace); ok {
+		return lister.(corelisters.SecretLister), nil
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(l.client, l.resync, informers.WithNamespace(namespace))
+	secretInformer := factory.Core().V1().Secrets()
+	lister := secretInformer.Lister()
+
+	factory.Start(l.stopCh)
+	if !informercache.WaitForCacheSync(l.stopCh, secretInformer.Informer().HasSynced) {
+		return nil, fmt.Errorf("failed to sync secret informer cache for namespace %s", namespace)
+	}
+
+	l.listers.Store(namespace, lister)
+	return lister, nil
+}
+
+// namespaceLock returns the mutex used to serialize first-time informer
+// bring-up for namespace, creating it if this is the first call for that
+// namespace.
+func (l *namespacedSecretLister) namespaceLock(namespace string) *sync.Mutex {
+	if mu, ok := l.mus.Load(namespace); ok {
+		return mu.(*sync.Mutex)
+	}
+
+	l.musMu.Lock()
+	defer l.musMu.Unlock()
+
+	if mu, ok := l.mus.Load(namespace); ok {
+		return mu.(*sync.Mutex)
+	}
+
+	mu := &sync.Mutex{}
+	l.mus.Store(namespace, mu)
+	return mu
+}
+
+// txtRecord is a minimal, backend-agnostic view of a TXT resource record.
+// Each backend translates its own API's representation into these so that
+// "does a record with this value already exist" can be answered the same
+// way regardless of whether the record came from SoftLayer or CIS.
+type txtRecord struct {
+	Name  string
+	Value string
+}
+
+// txtRecordWithValue returns the record among records whose Value matches
+// value exactly, or nil if none does.
+func txtRecordWithValue(records []txtRecord, value string) *txtRecord {
+	for i := range records {
+		if records[i].Value == value {
+			return &records[i]
+		}
+	}
+	return nil
+}